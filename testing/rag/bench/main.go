@@ -0,0 +1,208 @@
+// Command bench replays a query log against the RAG server across a
+// sweep of ANN index parameters and reports p50/p99 latency for each
+// operating point, so an operator can pick a hnsw.ef_search/ivfflat.probes
+// value that trades off speed for accuracy. It does not score recall:
+// the server has no document-retrieval step to source relevant-doc
+// judgments against (/v1/query never populates QueryResponse.Sources),
+// so a recall@k number here would just be noise.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// logEntry is one line of the replayed query log: just the query text to
+// send to /v1/query and time.
+type logEntry struct {
+	Query string `json:"query"`
+}
+
+type sweepPoint struct {
+	Algorithm string
+	EfSearch  int
+	Probes    int
+}
+
+type sweepResult struct {
+	Point     sweepPoint
+	P50Millis float64
+	P99Millis float64
+}
+
+func main() {
+	serverURL := flag.String("server", "http://localhost:8080", "RAG server base URL")
+	queryLog := flag.String("query-log", "", "path to a newline-delimited JSON query log")
+	flag.Parse()
+
+	if *queryLog == "" {
+		log.Fatal("-query-log is required")
+	}
+
+	entries, err := readQueryLog(*queryLog)
+	if err != nil {
+		log.Fatalf("reading query log: %v", err)
+	}
+
+	sweep := []sweepPoint{
+		{Algorithm: "hnsw", EfSearch: 10},
+		{Algorithm: "hnsw", EfSearch: 40},
+		{Algorithm: "hnsw", EfSearch: 100},
+		{Algorithm: "ivfflat", Probes: 1},
+		{Algorithm: "ivfflat", Probes: 10},
+	}
+
+	results := make([]sweepResult, 0, len(sweep))
+	for _, point := range sweep {
+		if err := applySweepPoint(*serverURL, point); err != nil {
+			log.Printf("skipping %+v: %v", point, err)
+			continue
+		}
+		result, err := runSweepPoint(*serverURL, point, entries)
+		if err != nil {
+			log.Printf("sweep point %+v failed: %v", point, err)
+			continue
+		}
+		results = append(results, result)
+	}
+
+	fmt.Printf("%-10s %-10s %-10s %-10s\n", "algorithm", "param", "p50 (ms)", "p99 (ms)")
+	for _, r := range results {
+		param := fmt.Sprintf("ef=%d", r.Point.EfSearch)
+		if r.Point.Algorithm == "ivfflat" {
+			param = fmt.Sprintf("probes=%d", r.Point.Probes)
+		}
+		fmt.Printf("%-10s %-10s %-10.1f %-10.1f\n", r.Point.Algorithm, param, r.P50Millis, r.P99Millis)
+	}
+}
+
+func readQueryLog(path string) ([]logEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []logEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var e logEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("parsing query log line: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func applySweepPoint(serverURL string, point sweepPoint) error {
+	body := map[string]any{
+		"algorithm": point.Algorithm,
+		"quantize":  false,
+		"params": map[string]int{
+			"ef_construction": 64,
+			"m":                16,
+			"ef_search":        point.EfSearch,
+			"lists":            100,
+			"probes":           point.Probes,
+		},
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	// The rebuild endpoint is admin-only: send the same ADMIN_API_KEY the
+	// server reads, as its X-Admin-API-Key header.
+	req, err := http.NewRequest(http.MethodPost, serverURL+"/cache/index/rebuild", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Admin-API-Key", os.Getenv("ADMIN_API_KEY"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rebuild failed with status %d", resp.StatusCode)
+	}
+
+	// Drain the rebuild's NDJSON progress stream before moving on, then
+	// clear the cache so /v1/query can't serve an answer cached under a
+	// previous operating point and mask this one's latency.
+	io.Copy(io.Discard, resp.Body)
+	return clearCache(serverURL)
+}
+
+func clearCache(serverURL string) error {
+	req, err := http.NewRequest(http.MethodDelete, serverURL+"/cache/clear", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cache clear failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func runSweepPoint(serverURL string, point sweepPoint, entries []logEntry) (sweepResult, error) {
+	var latencies []float64
+
+	for _, entry := range entries {
+		start := time.Now()
+		if err := queryOnce(serverURL, entry.Query); err != nil {
+			return sweepResult{}, err
+		}
+		latencies = append(latencies, time.Since(start).Seconds()*1000)
+	}
+
+	sort.Float64s(latencies)
+	return sweepResult{
+		Point:     point,
+		P50Millis: percentile(latencies, 0.50),
+		P99Millis: percentile(latencies, 0.99),
+	}, nil
+}
+
+func queryOnce(serverURL, query string) error {
+	payload, err := json.Marshal(map[string]any{"query": query})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(serverURL+"/v1/query", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p * float64(len(sorted)-1))
+	return sorted[idx]
+}
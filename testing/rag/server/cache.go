@@ -0,0 +1,375 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Cache is the common interface for every layer in the query-response
+// cache chain, from the in-process L1 up to the Postgres-backed
+// semantic L2. query is hashed exactly by layers that only support exact
+// matches; embedding is used by layers that support similarity search.
+// Every entry is scoped to tenantID so one tenant can never read, tag,
+// or evict another tenant's cached answers.
+type Cache interface {
+	Get(ctx context.Context, tenantID, query, embedding string) (*QueryResponse, bool)
+	Set(ctx context.Context, tenantID, query, embedding string, resp *QueryResponse, ttlSeconds int, tags []string) error
+	Invalidate(ctx context.Context, tenantID, query string) error
+	// ClearTenant drops every entry for tenantID, optionally restricted
+	// to entries carrying tag, for DELETE /cache/clear.
+	ClearTenant(ctx context.Context, tenantID, tag string) error
+}
+
+// CacheLayerStats reports hits and misses for a single cache layer, used
+// to break down /cache/stats by L1 exact hits vs L2 semantic hits.
+type CacheLayerStats struct {
+	Hits   int64
+	Misses int64
+}
+
+// memoryCacheEntry is the value stored against each tenant+query hash,
+// plus the wall-clock deadline it expires at.
+type memoryCacheEntry struct {
+	key       string
+	tenantID  string
+	tags      []string
+	resp      QueryResponse
+	expiresAt time.Time
+}
+
+// MemoryCache is an in-process LRU+TTL cache keyed by tenant and the
+// exact query hash. It exists to short-circuit repeated identical
+// queries without a Postgres round trip; it has no notion of semantic
+// similarity.
+type MemoryCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List // front = most recently used
+
+	hits   int64
+	misses int64
+}
+
+// NewMemoryCache builds an L1 cache holding up to capacity entries, each
+// valid for ttl before it is treated as a miss.
+func NewMemoryCache(capacity int, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func hashQuery(tenantID, query string) string {
+	sum := sha256.Sum256([]byte(tenantID + "\x00" + query))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *MemoryCache) Get(ctx context.Context, tenantID, query, embedding string) (*QueryResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := hashQuery(tenantID, query)
+	el, ok := m.entries[key]
+	if !ok {
+		m.misses++
+		return nil, false
+	}
+
+	entry := el.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		m.order.Remove(el)
+		delete(m.entries, key)
+		m.misses++
+		return nil, false
+	}
+
+	m.order.MoveToFront(el)
+	m.hits++
+	recordCacheHit("l1", 1)
+	resp := entry.resp
+	return &resp, true
+}
+
+func (m *MemoryCache) Set(ctx context.Context, tenantID, query, embedding string, resp *QueryResponse, ttlSeconds int, tags []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ttl := m.ttl
+	if ttlSeconds > 0 {
+		ttl = time.Duration(ttlSeconds) * time.Second
+	}
+
+	key := hashQuery(tenantID, query)
+	entry := &memoryCacheEntry{key: key, tenantID: tenantID, tags: tags, resp: *resp, expiresAt: time.Now().Add(ttl)}
+
+	if el, ok := m.entries[key]; ok {
+		el.Value = entry
+		m.order.MoveToFront(el)
+		return nil
+	}
+
+	el := m.order.PushFront(entry)
+	m.entries[key] = el
+
+	for m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		if oldest == nil {
+			break
+		}
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+
+	return nil
+}
+
+func (m *MemoryCache) Invalidate(ctx context.Context, tenantID, query string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := hashQuery(tenantID, query)
+	if el, ok := m.entries[key]; ok {
+		m.order.Remove(el)
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+func (m *MemoryCache) ClearTenant(ctx context.Context, tenantID, tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for el := m.order.Front(); el != nil; {
+		next := el.Next()
+		entry := el.Value.(*memoryCacheEntry)
+		if entry.tenantID == tenantID && (tag == "" || containsTag(entry.tags, tag)) {
+			m.order.Remove(el)
+			delete(m.entries, entry.key)
+		}
+		el = next
+	}
+	return nil
+}
+
+// evictExpired drops every entry for tenantID whose expiry deadline has
+// passed, for the background janitor. The deadline is fixed by the TTL
+// the entry was stored with; a tenant's tenant_config TTL is not applied
+// here, so an L1 entry lives for its stored TTL even when the tenant's
+// configured TTL is shorter.
+func (m *MemoryCache) evictExpired(tenantID string, now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	evicted := 0
+	for el := m.order.Front(); el != nil; {
+		next := el.Next()
+		entry := el.Value.(*memoryCacheEntry)
+		if entry.tenantID == tenantID && now.After(entry.expiresAt) {
+			m.order.Remove(el)
+			delete(m.entries, entry.key)
+			evicted++
+		}
+		el = next
+	}
+	return evicted
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryCache) Stats() CacheLayerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return CacheLayerStats{Hits: m.hits, Misses: m.misses}
+}
+
+// SemanticPgCache wraps pg_semantic_cache's similarity search as the L2
+// cache layer. This is the SQL the original checkCache/cacheResult
+// methods issued, moved here so it can sit behind the Cache interface and
+// extended with a tenant argument, caller-supplied tags and the entry's
+// remaining TTL.
+type SemanticPgCache struct {
+	dbPool     *pgxpool.Pool
+	threshold  float32
+	defaultTTL int
+
+	mu     sync.Mutex
+	hits   int64
+	misses int64
+}
+
+func NewSemanticPgCache(dbPool *pgxpool.Pool, threshold float32, defaultTTLSeconds int) *SemanticPgCache {
+	return &SemanticPgCache{dbPool: dbPool, threshold: threshold, defaultTTL: defaultTTLSeconds}
+}
+
+func (c *SemanticPgCache) Get(ctx context.Context, tenantID, query, embedding string) (*QueryResponse, bool) {
+	ctx, span := tracer.Start(ctx, "cache.l2.get")
+	defer span.End()
+
+	sqlQuery := `
+		SELECT
+			found,
+			result_data,
+			similarity_score,
+			ttl_remaining_seconds
+		FROM semantic_cache.get_cached_result(
+			$1::text,
+			$2::float4,
+			NULL,
+			$3::text
+		)
+	`
+
+	var found bool
+	var resultJSON []byte
+	var similarity float32
+	var ttlRemaining int
+
+	err := c.dbPool.QueryRow(ctx, sqlQuery, embedding, c.threshold, tenantID).Scan(&found, &resultJSON, &similarity, &ttlRemaining)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil || !found {
+		c.misses++
+		return nil, false
+	}
+
+	var resp QueryResponse
+	if err := json.Unmarshal(resultJSON, &resp); err != nil {
+		c.misses++
+		return nil, false
+	}
+
+	resp.SimilarityScore = similarity
+	resp.ExpiresAt = time.Now().Add(time.Duration(ttlRemaining) * time.Second)
+	c.hits++
+	recordCacheHit("l2", similarity)
+	return &resp, true
+}
+
+func (c *SemanticPgCache) Set(ctx context.Context, tenantID, query, embedding string, resp *QueryResponse, ttlSeconds int, tags []string) error {
+	respJSON, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	ttl := c.defaultTTL
+	if ttlSeconds > 0 {
+		ttl = ttlSeconds
+	}
+
+	if len(tags) == 0 {
+		tags = []string{"rag-test"}
+	}
+
+	cacheQuery := `
+		SELECT semantic_cache.cache_query(
+			$1::text,
+			$2::text,
+			$3::jsonb,
+			$4::integer,
+			$5::text[],
+			$6::text
+		)
+	`
+
+	_, err = c.dbPool.Exec(ctx, cacheQuery, query, embedding, string(respJSON), ttl, tags, tenantID)
+	return err
+}
+
+func (c *SemanticPgCache) Invalidate(ctx context.Context, tenantID, query string) error {
+	// pg_semantic_cache has no per-query delete; callers fall back to
+	// ClearTenant via the /cache/clear endpoint for now.
+	return fmt.Errorf("SemanticPgCache.Invalidate: not supported, use ClearTenant")
+}
+
+func (c *SemanticPgCache) ClearTenant(ctx context.Context, tenantID, tag string) error {
+	_, err := c.dbPool.Exec(ctx, "SELECT semantic_cache.clear_cache($1::text, $2::text)", tenantID, nullIfEmpty(tag))
+	return err
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (c *SemanticPgCache) Stats() CacheLayerStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheLayerStats{Hits: c.hits, Misses: c.misses}
+}
+
+// TieredCache checks l1 first and falls back to l2 on a miss, populating
+// l1 from the l2 result so the next identical query is served without a
+// Postgres round trip.
+type TieredCache struct {
+	l1 *MemoryCache
+	l2 *SemanticPgCache
+}
+
+func NewTieredCache(l1 *MemoryCache, l2 *SemanticPgCache) *TieredCache {
+	return &TieredCache{l1: l1, l2: l2}
+}
+
+func (t *TieredCache) Get(ctx context.Context, tenantID, query, embedding string) (*QueryResponse, bool) {
+	if resp, ok := t.l1.Get(ctx, tenantID, query, embedding); ok {
+		return resp, true
+	}
+
+	resp, ok := t.l2.Get(ctx, tenantID, query, embedding)
+	if !ok {
+		return nil, false
+	}
+
+	// Backfill L1 with the L2 entry's own remaining TTL, not the global
+	// default - otherwise a near-expiry (or short per-tenant) L2 answer
+	// gets re-cached in L1 for a full default TTL and keeps serving
+	// after the L2 entry has actually expired.
+	// Under a whole second left, skip the backfill: a 0-second TTL would
+	// make l1.Set fall back to the default.
+	if remaining := int(time.Until(resp.ExpiresAt).Seconds()); remaining > 0 {
+		_ = t.l1.Set(ctx, tenantID, query, embedding, resp, remaining, nil)
+	}
+	return resp, true
+}
+
+func (t *TieredCache) Set(ctx context.Context, tenantID, query, embedding string, resp *QueryResponse, ttlSeconds int, tags []string) error {
+	_ = t.l1.Set(ctx, tenantID, query, embedding, resp, ttlSeconds, tags)
+	return t.l2.Set(ctx, tenantID, query, embedding, resp, ttlSeconds, tags)
+}
+
+func (t *TieredCache) Invalidate(ctx context.Context, tenantID, query string) error {
+	_ = t.l1.Invalidate(ctx, tenantID, query)
+	return t.l2.Invalidate(ctx, tenantID, query)
+}
+
+func (t *TieredCache) ClearTenant(ctx context.Context, tenantID, tag string) error {
+	_ = t.l1.ClearTenant(ctx, tenantID, tag)
+	return t.l2.ClearTenant(ctx, tenantID, tag)
+}
+
+// LayerStats reports L1/L2 hit counts for /cache/stats.
+func (t *TieredCache) LayerStats() (l1, l2 CacheLayerStats) {
+	return t.l1.Stats(), t.l2.Stats()
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EmbeddingProvider turns text into a pgvector literal (e.g. "[0.1,0.2,...]")
+// so it can be passed straight into semantic_cache.cache_query /
+// get_cached_result without further conversion.
+type EmbeddingProvider interface {
+	// Embed returns the embedding for a single piece of text.
+	Embed(ctx context.Context, text string) (string, error)
+	// EmbedBatch embeds many texts at once, falling back to sequential
+	// per-item calls for providers that have no native batch endpoint.
+	EmbedBatch(ctx context.Context, texts []string) ([]string, error)
+	// Dimensions reports the vector width this provider produces, used to
+	// validate results before they are handed to Postgres.
+	Dimensions() int
+}
+
+// EmbeddingConfig configures provider selection and request behavior.
+type EmbeddingConfig struct {
+	Provider       string
+	APIKey         string
+	Model          string
+	BaseURL        string
+	RequestTimeout time.Duration
+	MaxRetries     int
+}
+
+func loadEmbeddingConfig() EmbeddingConfig {
+	return EmbeddingConfig{
+		Provider:       getEnv("EMBEDDING_PROVIDER", "fake"),
+		APIKey:         getEnv("EMBEDDING_API_KEY", ""),
+		Model:          getEnv("EMBEDDING_MODEL", ""),
+		BaseURL:        getEnv("EMBEDDING_BASE_URL", ""),
+		RequestTimeout: 10 * time.Second,
+		MaxRetries:     3,
+	}
+}
+
+// newEmbeddingProvider builds the EmbeddingProvider selected by
+// EMBEDDING_PROVIDER ("openai", "voyage", "cohere", "local", or "fake"),
+// wrapped with OpenTelemetry spans and latency metrics.
+func newEmbeddingProvider(cfg EmbeddingConfig) (EmbeddingProvider, error) {
+	client := &http.Client{Timeout: cfg.RequestTimeout}
+
+	var provider EmbeddingProvider
+	switch strings.ToLower(cfg.Provider) {
+	case "openai":
+		provider = &openAIEmbeddingProvider{
+			httpProvider: httpProvider{client: client, cfg: cfg},
+			model:        defaultString(cfg.Model, "text-embedding-3-small"),
+			dimensions:   1536,
+		}
+	case "voyage":
+		provider = &voyageEmbeddingProvider{
+			httpProvider: httpProvider{client: client, cfg: cfg},
+			model:        defaultString(cfg.Model, "voyage-2"),
+			dimensions:   1024,
+		}
+	case "cohere":
+		provider = &cohereEmbeddingProvider{
+			httpProvider: httpProvider{client: client, cfg: cfg},
+			model:        defaultString(cfg.Model, "embed-english-v3.0"),
+			dimensions:   1024,
+		}
+	case "local":
+		provider = &localEmbeddingProvider{
+			httpProvider: httpProvider{client: client, cfg: cfg},
+			baseURL:      defaultString(cfg.BaseURL, "http://localhost:8001"),
+			dimensions:   384,
+		}
+	case "fake", "":
+		provider = &fakeEmbeddingProvider{dimensions: 1536}
+	default:
+		return nil, fmt.Errorf("unknown embedding provider %q", cfg.Provider)
+	}
+
+	return &instrumentedEmbeddingProvider{wrapped: provider}, nil
+}
+
+// instrumentedEmbeddingProvider wraps any EmbeddingProvider with an
+// OpenTelemetry span and an embedding_latency_seconds observation per
+// call, so every backend gets the same instrumentation for free.
+type instrumentedEmbeddingProvider struct {
+	wrapped EmbeddingProvider
+}
+
+func (p *instrumentedEmbeddingProvider) Dimensions() int { return p.wrapped.Dimensions() }
+
+func (p *instrumentedEmbeddingProvider) Embed(ctx context.Context, text string) (string, error) {
+	ctx, span := tracer.Start(ctx, "embedding.embed")
+	defer span.End()
+
+	start := time.Now()
+	result, err := p.wrapped.Embed(ctx, text)
+	embeddingLatencySeconds.Observe(time.Since(start).Seconds())
+	return result, err
+}
+
+func (p *instrumentedEmbeddingProvider) EmbedBatch(ctx context.Context, texts []string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "embedding.embed_batch")
+	defer span.End()
+
+	start := time.Now()
+	result, err := p.wrapped.EmbedBatch(ctx, texts)
+	embeddingLatencySeconds.Observe(time.Since(start).Seconds())
+	return result, err
+}
+
+func defaultString(v, fallback string) string {
+	if v == "" {
+		return fallback
+	}
+	return v
+}
+
+// httpProvider holds the pieces shared by every HTTP-backed provider:
+// the client, config, and the retry/backoff loop around a single call.
+type httpProvider struct {
+	client *http.Client
+	cfg    EmbeddingConfig
+}
+
+// doWithRetry issues req (rebuilt by reqFn on every attempt, since the
+// body reader is consumed) and retries on 429s and 5xxs with exponential
+// backoff, up to cfg.MaxRetries retries (cfg.MaxRetries+1 attempts in all).
+func (p *httpProvider) doWithRetry(ctx context.Context, reqFn func(ctx context.Context) (*http.Request, error)) ([]byte, error) {
+	var lastErr error
+	backoff := 250 * time.Millisecond
+
+	for attempt := 0; attempt <= p.cfg.MaxRetries; attempt++ {
+		req, err := reqFn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			lastErr = err
+		} else {
+			body, readErr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if readErr != nil {
+				lastErr = readErr
+			} else if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+				lastErr = fmt.Errorf("embedding request failed with status %d: %s", resp.StatusCode, string(body))
+			} else if resp.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("embedding request failed with status %d: %s", resp.StatusCode, string(body))
+			} else {
+				return body, nil
+			}
+		}
+
+		if attempt == p.cfg.MaxRetries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return nil, fmt.Errorf("embedding request failed after %d attempts: %w", p.cfg.MaxRetries+1, lastErr)
+}
+
+func floatsToVectorLiteral(vec []float32) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, v := range vec {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%.6f", v)
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+func validateDimensions(vec []float32, want int) error {
+	if len(vec) != want {
+		return fmt.Errorf("embedding has %d dimensions, expected %d", len(vec), want)
+	}
+	return nil
+}
+
+// openAIEmbeddingProvider calls OpenAI's /v1/embeddings endpoint.
+type openAIEmbeddingProvider struct {
+	httpProvider
+	model      string
+	dimensions int
+}
+
+func (p *openAIEmbeddingProvider) Dimensions() int { return p.dimensions }
+
+func (p *openAIEmbeddingProvider) Embed(ctx context.Context, text string) (string, error) {
+	vecs, err := p.embedBatch(ctx, []string{text})
+	if err != nil {
+		return "", err
+	}
+	return vecs[0], nil
+}
+
+func (p *openAIEmbeddingProvider) EmbedBatch(ctx context.Context, texts []string) ([]string, error) {
+	return p.embedBatch(ctx, texts)
+}
+
+func (p *openAIEmbeddingProvider) embedBatch(ctx context.Context, texts []string) ([]string, error) {
+	baseURL := defaultString(p.cfg.BaseURL, "https://api.openai.com")
+	reqBody, err := json.Marshal(map[string]any{
+		"model": p.model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.doWithRetry(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/v1/embeddings", bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+p.cfg.APIKey)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("parsing openai embedding response: %w", err)
+	}
+
+	out := make([]string, len(parsed.Data))
+	for i, d := range parsed.Data {
+		if err := validateDimensions(d.Embedding, p.dimensions); err != nil {
+			return nil, err
+		}
+		out[i] = floatsToVectorLiteral(d.Embedding)
+	}
+	return out, nil
+}
+
+// voyageEmbeddingProvider calls Voyage AI's /v1/embeddings endpoint.
+type voyageEmbeddingProvider struct {
+	httpProvider
+	model      string
+	dimensions int
+}
+
+func (p *voyageEmbeddingProvider) Dimensions() int { return p.dimensions }
+
+func (p *voyageEmbeddingProvider) Embed(ctx context.Context, text string) (string, error) {
+	vecs, err := p.EmbedBatch(ctx, []string{text})
+	if err != nil {
+		return "", err
+	}
+	return vecs[0], nil
+}
+
+func (p *voyageEmbeddingProvider) EmbedBatch(ctx context.Context, texts []string) ([]string, error) {
+	baseURL := defaultString(p.cfg.BaseURL, "https://api.voyageai.com")
+	reqBody, err := json.Marshal(map[string]any{
+		"model": p.model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.doWithRetry(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/v1/embeddings", bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+p.cfg.APIKey)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("parsing voyage embedding response: %w", err)
+	}
+
+	out := make([]string, len(parsed.Data))
+	for i, d := range parsed.Data {
+		if err := validateDimensions(d.Embedding, p.dimensions); err != nil {
+			return nil, err
+		}
+		out[i] = floatsToVectorLiteral(d.Embedding)
+	}
+	return out, nil
+}
+
+// cohereEmbeddingProvider calls Cohere's /v1/embed endpoint.
+type cohereEmbeddingProvider struct {
+	httpProvider
+	model      string
+	dimensions int
+}
+
+func (p *cohereEmbeddingProvider) Dimensions() int { return p.dimensions }
+
+func (p *cohereEmbeddingProvider) Embed(ctx context.Context, text string) (string, error) {
+	vecs, err := p.EmbedBatch(ctx, []string{text})
+	if err != nil {
+		return "", err
+	}
+	return vecs[0], nil
+}
+
+func (p *cohereEmbeddingProvider) EmbedBatch(ctx context.Context, texts []string) ([]string, error) {
+	baseURL := defaultString(p.cfg.BaseURL, "https://api.cohere.com")
+	reqBody, err := json.Marshal(map[string]any{
+		"model":      p.model,
+		"texts":      texts,
+		"input_type": "search_document",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.doWithRetry(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/v1/embed", bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+p.cfg.APIKey)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("parsing cohere embedding response: %w", err)
+	}
+
+	out := make([]string, len(parsed.Embeddings))
+	for i, e := range parsed.Embeddings {
+		if err := validateDimensions(e, p.dimensions); err != nil {
+			return nil, err
+		}
+		out[i] = floatsToVectorLiteral(e)
+	}
+	return out, nil
+}
+
+// localEmbeddingProvider calls a self-hosted sentence-transformers HTTP
+// endpoint (e.g. text-embeddings-inference or a small Flask wrapper)
+// that accepts {"inputs": [...]}
+// and returns a bare list of vectors.
+type localEmbeddingProvider struct {
+	httpProvider
+	baseURL    string
+	dimensions int
+}
+
+func (p *localEmbeddingProvider) Dimensions() int { return p.dimensions }
+
+func (p *localEmbeddingProvider) Embed(ctx context.Context, text string) (string, error) {
+	vecs, err := p.EmbedBatch(ctx, []string{text})
+	if err != nil {
+		return "", err
+	}
+	return vecs[0], nil
+}
+
+func (p *localEmbeddingProvider) EmbedBatch(ctx context.Context, texts []string) ([]string, error) {
+	reqBody, err := json.Marshal(map[string]any{"inputs": texts})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.doWithRetry(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/embed", bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var vectors [][]float32
+	if err := json.Unmarshal(body, &vectors); err != nil {
+		return nil, fmt.Errorf("parsing local embedding response: %w", err)
+	}
+
+	out := make([]string, len(vectors))
+	for i, v := range vectors {
+		if err := validateDimensions(v, p.dimensions); err != nil {
+			return nil, err
+		}
+		out[i] = floatsToVectorLiteral(v)
+	}
+	return out, nil
+}
+
+// fakeEmbeddingProvider reproduces the old generateMockEmbedding behavior
+// behind the EmbeddingProvider interface, so tests and local development
+// don't need network access or API keys.
+type fakeEmbeddingProvider struct {
+	dimensions int
+}
+
+func (p *fakeEmbeddingProvider) Dimensions() int { return p.dimensions }
+
+func (p *fakeEmbeddingProvider) Embed(ctx context.Context, text string) (string, error) {
+	vec := make([]float32, p.dimensions)
+	for i := range vec {
+		vec[i] = float32(len(text)+i) / float32(p.dimensions)
+	}
+	return floatsToVectorLiteral(vec), nil
+}
+
+func (p *fakeEmbeddingProvider) EmbedBatch(ctx context.Context, texts []string) ([]string, error) {
+	out := make([]string, len(texts))
+	for i, t := range texts {
+		v, err := p.Embed(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
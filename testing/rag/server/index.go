@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// IndexConfig mirrors the semantic_cache.index_config row read at
+// startup. It drives both the ANN index DDL issued by rebuildIndex and
+// the per-session search parameters applied to each new pooled connection.
+type IndexConfig struct {
+	Algorithm      string `json:"algorithm"` // "hnsw" or "ivfflat"
+	M              int    `json:"m,omitempty"`
+	EfConstruction int    `json:"ef_construction,omitempty"`
+	EfSearch       int    `json:"ef_search,omitempty"`
+	Lists          int    `json:"lists,omitempty"`
+	Probes         int    `json:"probes,omitempty"`
+	Quantize       bool   `json:"quantize"`
+}
+
+// liveIndexConfig holds the ANN tuning parameters currently applied to
+// the connection pool. It exists because poolConfig.AfterConnect reads
+// it on every new connection: once rebuildIndex stores a new config and
+// resets the pool, freshly-opened connections pick up the change
+// immediately instead of waiting for a process restart.
+type liveIndexConfig struct {
+	mu  sync.RWMutex
+	cfg IndexConfig
+}
+
+func newLiveIndexConfig(cfg IndexConfig) *liveIndexConfig {
+	return &liveIndexConfig{cfg: cfg}
+}
+
+func (l *liveIndexConfig) Load() IndexConfig {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg
+}
+
+func (l *liveIndexConfig) Store(cfg IndexConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+}
+
+// loadIndexConfig reads the active tuning parameters from
+// semantic_cache.index_config, falling back to sane HNSW defaults if the
+// table is empty or the extension hasn't initialized it yet.
+func loadIndexConfig(ctx context.Context, pool *pgxpool.Pool) (IndexConfig, error) {
+	cfg := IndexConfig{Algorithm: "hnsw", M: 16, EfConstruction: 64, EfSearch: 40}
+
+	row := pool.QueryRow(ctx, `
+		SELECT algorithm, m, ef_construction, ef_search, lists, probes, quantize
+		FROM semantic_cache.index_config
+		ORDER BY updated_at DESC
+		LIMIT 1
+	`)
+	err := row.Scan(&cfg.Algorithm, &cfg.M, &cfg.EfConstruction, &cfg.EfSearch, &cfg.Lists, &cfg.Probes, &cfg.Quantize)
+	if err != nil {
+		return cfg, nil // no row yet: caller keeps the defaults above
+	}
+	return cfg, nil
+}
+
+// indexRebuildRequest is the body for POST /cache/index/rebuild.
+type indexRebuildRequest struct {
+	Algorithm string      `json:"algorithm" binding:"required"`
+	Params    IndexParams `json:"params"`
+	Quantize  bool        `json:"quantize"`
+}
+
+// IndexParams holds the tunable knobs for whichever algorithm was
+// requested; unused fields for the other algorithm are simply ignored.
+type IndexParams struct {
+	M              int `json:"m"`
+	EfConstruction int `json:"ef_construction"`
+	EfSearch       int `json:"ef_search"`
+	Lists          int `json:"lists"`
+	Probes         int `json:"probes"`
+}
+
+// defaultEfSearch and defaultProbes are applied whenever a rebuild
+// request omits its algorithm's search-time parameter, so
+// index_config never persists a value pgvector would reject (SET
+// hnsw.ef_search/ivfflat.probes both require a value >= 1).
+const (
+	defaultEfSearch = 40
+	defaultProbes   = 10
+)
+
+func clampSearchParam(v, defaultValue int) int {
+	if v < 1 {
+		return defaultValue
+	}
+	return v
+}
+
+// rebuildIndex drops and recreates the ANN index on
+// semantic_cache.cache_entries, streaming one JSON progress line per
+// step so the client (or an admin curling the endpoint) can watch it
+// happen on a cache with millions of rows.
+func (s *Server) rebuildIndex(c *gin.Context) {
+	var req indexRebuildRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+	flusher, canFlush := c.Writer.(http.Flusher)
+
+	writeProgress := func(step, status string) {
+		line, _ := json.Marshal(gin.H{"step": step, "status": status})
+		c.Writer.Write(append(line, '\n'))
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+
+	ctx := c.Request.Context()
+
+	if req.Quantize {
+		writeProgress("quantize", "started")
+		if err := s.quantizeStoredEmbeddings(ctx); err != nil {
+			writeProgress("quantize", "failed: "+err.Error())
+			return
+		}
+		writeProgress("quantize", "done")
+	}
+
+	writeProgress("drop_index", "started")
+	if _, err := s.dbPool.Exec(ctx, "DROP INDEX IF EXISTS semantic_cache.cache_entries_embedding_idx"); err != nil {
+		writeProgress("drop_index", "failed: "+err.Error())
+		return
+	}
+	writeProgress("drop_index", "done")
+
+	ddl, err := buildIndexDDL(req.Algorithm, req.Params)
+	if err != nil {
+		writeProgress("create_index", "failed: "+err.Error())
+		return
+	}
+
+	writeProgress("create_index", "started")
+	if _, err := s.dbPool.Exec(ctx, ddl); err != nil {
+		writeProgress("create_index", "failed: "+err.Error())
+		return
+	}
+	writeProgress("create_index", "done")
+
+	cfg := IndexConfig{
+		Algorithm:      req.Algorithm,
+		M:              req.Params.M,
+		EfConstruction: req.Params.EfConstruction,
+		EfSearch:       clampSearchParam(req.Params.EfSearch, defaultEfSearch),
+		Lists:          req.Params.Lists,
+		Probes:         clampSearchParam(req.Params.Probes, defaultProbes),
+		Quantize:       req.Quantize,
+	}
+	writeProgress("save_config", "started")
+	if err := saveIndexConfig(ctx, s.dbPool, cfg); err != nil {
+		writeProgress("save_config", "failed: "+err.Error())
+		return
+	}
+	writeProgress("save_config", "done")
+
+	// Push the new config live: store it for the next AfterConnect call
+	// and reset the pool so pooled connections pick it up on their next
+	// acquisition, instead of only taking effect after a full restart.
+	writeProgress("apply_config", "started")
+	s.indexConfig.Store(cfg)
+	s.dbPool.Reset()
+	writeProgress("apply_config", "done")
+
+	log.Printf("✓ Rebuilt semantic cache index: %+v", cfg)
+	writeProgress("rebuild", "complete")
+}
+
+func buildIndexDDL(algorithm string, p IndexParams) (string, error) {
+	switch algorithm {
+	case "hnsw":
+		m := p.M
+		if m == 0 {
+			m = 16
+		}
+		efConstruction := p.EfConstruction
+		if efConstruction == 0 {
+			efConstruction = 64
+		}
+		return fmt.Sprintf(
+			"CREATE INDEX cache_entries_embedding_idx ON semantic_cache.cache_entries USING hnsw (embedding vector_cosine_ops) WITH (m = %d, ef_construction = %d)",
+			m, efConstruction,
+		), nil
+	case "ivfflat":
+		lists := p.Lists
+		if lists == 0 {
+			lists = 100
+		}
+		return fmt.Sprintf(
+			"CREATE INDEX cache_entries_embedding_idx ON semantic_cache.cache_entries USING ivfflat (embedding vector_cosine_ops) WITH (lists = %d)",
+			lists,
+		), nil
+	default:
+		return "", fmt.Errorf("unknown index algorithm %q", algorithm)
+	}
+}
+
+// quantizeStoredEmbeddings converts the stored float32 embeddings to
+// int8 scalar-quantized vectors, cutting storage roughly 4x at the cost
+// of some recall. pg_semantic_cache keeps the quantized copy alongside
+// the original so callers can fall back if recall drops too far.
+func (s *Server) quantizeStoredEmbeddings(ctx context.Context) error {
+	_, err := s.dbPool.Exec(ctx, "SELECT semantic_cache.quantize_embeddings('int8')")
+	return err
+}
+
+func saveIndexConfig(ctx context.Context, pool *pgxpool.Pool, cfg IndexConfig) error {
+	_, err := pool.Exec(ctx, `
+		INSERT INTO semantic_cache.index_config
+			(algorithm, m, ef_construction, ef_search, lists, probes, quantize, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+	`, cfg.Algorithm, cfg.M, cfg.EfConstruction, cfg.EfSearch, cfg.Lists, cfg.Probes, cfg.Quantize)
+	return err
+}
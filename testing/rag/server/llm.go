@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LLMClient generates an answer for a query, optionally grounded in
+// retrieved document context. Implementations stream tokens to onToken
+// as they arrive and return the fully concatenated answer so callers can
+// cache it once the stream completes.
+type LLMClient interface {
+	Generate(ctx context.Context, query string, docs []string) (string, error)
+	GenerateStream(ctx context.Context, query string, docs []string, onToken func(string)) (string, error)
+}
+
+// LLMConfig configures model selection and generation parameters,
+// mirroring EmbeddingConfig's env-driven setup.
+type LLMConfig struct {
+	Provider    string
+	APIKey      string
+	Model       string
+	BaseURL     string
+	Temperature float32
+	MaxTokens   int
+}
+
+func loadLLMConfig() LLMConfig {
+	return LLMConfig{
+		Provider:    getEnv("LLM_PROVIDER", "fake"),
+		APIKey:      getEnv("LLM_API_KEY", ""),
+		Model:       getEnv("LLM_MODEL", ""),
+		BaseURL:     getEnv("LLM_BASE_URL", ""),
+		Temperature: getEnvFloat("LLM_TEMPERATURE", 0.7),
+		MaxTokens:   getEnvInt("LLM_MAX_TOKENS", 1024),
+	}
+}
+
+// newLLMClient builds the LLMClient selected by LLM_PROVIDER ("openai",
+// "anthropic", or "fake"), wrapped with OpenTelemetry spans and latency
+// metrics.
+func newLLMClient(cfg LLMConfig) (LLMClient, error) {
+	client := &http.Client{}
+
+	var llmClient LLMClient
+	switch strings.ToLower(cfg.Provider) {
+	case "openai":
+		llmClient = &openAILLMClient{client: client, cfg: cfg, model: defaultString(cfg.Model, "gpt-4o")}
+	case "anthropic":
+		llmClient = &anthropicLLMClient{client: client, cfg: cfg, model: defaultString(cfg.Model, "claude-3-5-sonnet-latest")}
+	case "fake", "":
+		llmClient = &fakeLLMClient{}
+	default:
+		return nil, fmt.Errorf("unknown llm provider %q", cfg.Provider)
+	}
+
+	return &instrumentedLLMClient{wrapped: llmClient}, nil
+}
+
+// instrumentedLLMClient wraps any LLMClient with an OpenTelemetry span
+// and an llm_latency_seconds observation per call, so every backend
+// gets the same instrumentation for free.
+type instrumentedLLMClient struct {
+	wrapped LLMClient
+}
+
+func (c *instrumentedLLMClient) Generate(ctx context.Context, query string, docs []string) (string, error) {
+	ctx, span := tracer.Start(ctx, "llm.generate")
+	defer span.End()
+
+	start := time.Now()
+	answer, err := c.wrapped.Generate(ctx, query, docs)
+	llmLatencySeconds.Observe(time.Since(start).Seconds())
+	return answer, err
+}
+
+func (c *instrumentedLLMClient) GenerateStream(ctx context.Context, query string, docs []string, onToken func(string)) (string, error) {
+	ctx, span := tracer.Start(ctx, "llm.generate_stream")
+	defer span.End()
+
+	start := time.Now()
+	answer, err := c.wrapped.GenerateStream(ctx, query, docs, onToken)
+	llmLatencySeconds.Observe(time.Since(start).Seconds())
+	return answer, err
+}
+
+func buildPrompt(query string, docs []string) string {
+	if len(docs) == 0 {
+		return query
+	}
+	var b strings.Builder
+	b.WriteString("Context:\n")
+	for _, d := range docs {
+		b.WriteString("- ")
+		b.WriteString(d)
+		b.WriteString("\n")
+	}
+	b.WriteString("\nQuestion: ")
+	b.WriteString(query)
+	return b.String()
+}
+
+// openAILLMClient calls OpenAI's /v1/chat/completions endpoint.
+type openAILLMClient struct {
+	client *http.Client
+	cfg    LLMConfig
+	model  string
+}
+
+func (c *openAILLMClient) Generate(ctx context.Context, query string, docs []string) (string, error) {
+	return c.GenerateStream(ctx, query, docs, nil)
+}
+
+func (c *openAILLMClient) GenerateStream(ctx context.Context, query string, docs []string, onToken func(string)) (string, error) {
+	baseURL := defaultString(c.cfg.BaseURL, "https://api.openai.com")
+	reqBody, err := json.Marshal(map[string]any{
+		"model":       c.model,
+		"temperature": c.cfg.Temperature,
+		"max_tokens":  c.cfg.MaxTokens,
+		"stream":      onToken != nil,
+		"messages": []map[string]string{
+			{"role": "user", "content": buildPrompt(query, docs)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/v1/chat/completions", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.cfg.APIKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("openai chat completion failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	if onToken == nil {
+		var parsed struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+			return "", err
+		}
+		if len(parsed.Choices) == 0 {
+			return "", fmt.Errorf("openai returned no choices")
+		}
+		return parsed.Choices[0].Message.Content, nil
+	}
+
+	return readOpenAISSE(resp.Body, onToken)
+}
+
+func readOpenAISSE(body io.Reader, onToken func(string)) (string, error) {
+	var full strings.Builder
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		payload := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if payload == "[DONE]" {
+			break
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			continue
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		token := chunk.Choices[0].Delta.Content
+		if token == "" {
+			continue
+		}
+		full.WriteString(token)
+		onToken(token)
+	}
+	return full.String(), scanner.Err()
+}
+
+// anthropicLLMClient calls Anthropic's /v1/messages endpoint.
+type anthropicLLMClient struct {
+	client *http.Client
+	cfg    LLMConfig
+	model  string
+}
+
+func (c *anthropicLLMClient) Generate(ctx context.Context, query string, docs []string) (string, error) {
+	return c.GenerateStream(ctx, query, docs, nil)
+}
+
+func (c *anthropicLLMClient) GenerateStream(ctx context.Context, query string, docs []string, onToken func(string)) (string, error) {
+	baseURL := defaultString(c.cfg.BaseURL, "https://api.anthropic.com")
+	reqBody, err := json.Marshal(map[string]any{
+		"model":       c.model,
+		"max_tokens":  c.cfg.MaxTokens,
+		"temperature": c.cfg.Temperature,
+		"stream":      onToken != nil,
+		"messages": []map[string]string{
+			{"role": "user", "content": buildPrompt(query, docs)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/v1/messages", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", c.cfg.APIKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("anthropic messages request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	if onToken == nil {
+		var parsed struct {
+			Content []struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+			return "", err
+		}
+		var full strings.Builder
+		for _, block := range parsed.Content {
+			full.WriteString(block.Text)
+		}
+		return full.String(), nil
+	}
+
+	return readAnthropicSSE(resp.Body, onToken)
+}
+
+func readAnthropicSSE(body io.Reader, onToken func(string)) (string, error) {
+	var full strings.Builder
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		payload := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		var event struct {
+			Type  string `json:"type"`
+			Delta struct {
+				Text string `json:"text"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			continue
+		}
+		if event.Type != "content_block_delta" || event.Delta.Text == "" {
+			continue
+		}
+		full.WriteString(event.Delta.Text)
+		onToken(event.Delta.Text)
+	}
+	return full.String(), scanner.Err()
+}
+
+// fakeLLMClient returns the old canned mock answer behind the LLMClient
+// interface, for tests and local development without API keys. It answers
+// immediately; the old simulated 2-second delay is not kept.
+type fakeLLMClient struct{}
+
+func (c *fakeLLMClient) Generate(ctx context.Context, query string, docs []string) (string, error) {
+	return fmt.Sprintf("This is a mock answer for: %s. In production, this would be generated by GPT-4 or Claude based on retrieved documents.", query), nil
+}
+
+func (c *fakeLLMClient) GenerateStream(ctx context.Context, query string, docs []string, onToken func(string)) (string, error) {
+	answer, err := c.Generate(ctx, query, docs)
+	if err != nil {
+		return "", err
+	}
+	if onToken != nil {
+		for _, word := range strings.Fields(answer) {
+			onToken(word + " ")
+		}
+	}
+	return answer, nil
+}
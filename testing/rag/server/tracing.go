@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/exaring/otelpgx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+var tracer = otel.Tracer("pg_semantic_cache/rag-server")
+
+// setupTracing wires an OTLP/gRPC span exporter when
+// OTEL_EXPORTER_OTLP_ENDPOINT is set. With no endpoint configured, the
+// global no-op provider stays in place, so instrumentation throughout
+// the codebase can be unconditional without paying an exporter cost in
+// environments that haven't opted in.
+func setupTracing(ctx context.Context) (shutdown func(context.Context) error) {
+	noop := func(context.Context) error { return nil }
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return noop
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		log.Printf("WARNING: could not start OTLP trace exporter: %v", err)
+		return noop
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceNameKey.String("pg_semantic_cache-rag-server")))
+	if err != nil {
+		res = resource.Default()
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown
+}
+
+// pgxTracer returns the otelpgx tracer used as pgxpool.Config.ConnConfig.Tracer
+// so cache SQL calls show up as child spans of whatever span is active
+// on the context passed into each query.
+func pgxTracer() *otelpgx.Tracer {
+	return otelpgx.NewTracer()
+}